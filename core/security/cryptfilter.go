@@ -0,0 +1,384 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package security
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha256"
+	"errors"
+)
+
+// CryptFilter implements one of the PDF crypt filter methods (/CFM) used to
+// encrypt and decrypt streams, strings and embedded files referenced from a
+// V4 or V5 encryption dictionary. StdEncryptDict.CryptFilters holds the
+// filters declared in the dictionary's CF entry, keyed by name; StmF, StrF
+// and EFF select which entry applies to streams, strings and embedded files
+// respectively.
+type CryptFilter interface {
+	// Name returns the /CFM name this filter is registered under, e.g.
+	// "V2", "AESV2", "AESV3" or "AESV3GCM".
+	Name() string
+	// KeySize returns the length, in bytes, of the key this filter expects
+	// to derive its per-object key from.
+	KeySize() int
+
+	// EncryptStream encrypts a stream's raw bytes for the indirect object
+	// objNum/objGen, using fkey as the file encryption key.
+	EncryptStream(objNum, objGen int64, fkey, data []byte) ([]byte, error)
+	// DecryptStream reverses EncryptStream.
+	DecryptStream(objNum, objGen int64, fkey, data []byte) ([]byte, error)
+	// EncryptString encrypts a string's raw bytes for the indirect object
+	// objNum/objGen, using fkey as the file encryption key.
+	EncryptString(objNum, objGen int64, fkey, data []byte) ([]byte, error)
+	// DecryptString reverses EncryptString.
+	DecryptString(objNum, objGen int64, fkey, data []byte) ([]byte, error)
+}
+
+// CryptFilterFactory builds a CryptFilter sized for a file encryption key of
+// the given length, in bytes (used only by filters such as "V2" whose key
+// size depends on the encryption dictionary's Length entry).
+type CryptFilterFactory func(length int) CryptFilter
+
+var cryptFilterRegistry = map[string]CryptFilterFactory{}
+
+// RegisterCryptFilter makes a CryptFilter constructor available under the
+// encryption dictionary's /CFM name name. It panics on a duplicate name, to
+// catch accidental double registration at init time rather than silently
+// shadowing a built-in filter.
+func RegisterCryptFilter(name string, factory CryptFilterFactory) {
+	if _, ok := cryptFilterRegistry[name]; ok {
+		panic("security: crypt filter " + name + " already registered")
+	}
+	cryptFilterRegistry[name] = factory
+}
+
+// GetCryptFilter returns the CryptFilter registered under name, sized for a
+// file encryption key of length bytes. ok is false if name is not
+// registered.
+func GetCryptFilter(name string, length int) (filter CryptFilter, ok bool) {
+	factory, ok := cryptFilterRegistry[name]
+	if !ok {
+		return nil, false
+	}
+	return factory(length), true
+}
+
+func init() {
+	RegisterCryptFilter("V2", func(length int) CryptFilter {
+		return filterV2{length: length}
+	})
+	RegisterCryptFilter("AESV2", func(int) CryptFilter {
+		return filterAESCBC{name: "AESV2", keySize: 16, perObjectKey: true}
+	})
+	RegisterCryptFilter("AESV3", func(int) CryptFilter {
+		return filterAESCBC{name: "AESV3", keySize: 32, perObjectKey: false}
+	})
+	// AESV3GCM is not a standard /CFM name: it opts new documents produced
+	// by this library into authenticated encryption so tampering with an
+	// encrypted object stream is detected at decrypt time instead of
+	// silently yielding garbage plaintext. Third-party PDFs never declare
+	// it, so readers fall back to the standard filters unchanged.
+	RegisterCryptFilter("AESV3GCM", func(int) CryptFilter {
+		return filterAESGCM{}
+	})
+}
+
+// makeObjectKey derives the per-object encryption key for legacy (V2,
+// AESV2) crypt filters, per Algorithm 1 of ISO 32000-1 7.6.2. aesSalt must
+// be true for AESV2, false for the RC4-based V2 filter.
+func makeObjectKey(fkey []byte, objNum, objGen int64, aesSalt bool) []byte {
+	h := md5.New()
+	h.Write(fkey)
+	h.Write([]byte{
+		byte(objNum), byte(objNum >> 8), byte(objNum >> 16),
+		byte(objGen), byte(objGen >> 8),
+	})
+	if aesSalt {
+		h.Write([]byte("sAlT"))
+	}
+	sum := h.Sum(nil)
+	n := len(fkey) + 5
+	if n > 16 {
+		n = 16
+	}
+	return sum[:n]
+}
+
+// makeObjectKeyAES256 derives a 32-byte per-object key for the AESV3GCM
+// filter, analogous to makeObjectKey but over SHA-256 so the full AES-256
+// key space is covered (Algorithm 1's MD5 derivation tops out at 16 bytes).
+// Deriving a distinct key per object means a GCM nonce collision, however
+// unlikely, only ever compromises the one colliding object rather than
+// every object sharing the file encryption key.
+func makeObjectKeyAES256(fkey []byte, objNum, objGen int64) []byte {
+	h := sha256.New()
+	h.Write(fkey)
+	h.Write([]byte{
+		byte(objNum), byte(objNum >> 8), byte(objNum >> 16),
+		byte(objGen), byte(objGen >> 8),
+	})
+	h.Write([]byte("sAlT"))
+	return h.Sum(nil)
+}
+
+// cryptFilterFor resolves the CryptFilter that name (the dictionary's StmF,
+// StrF or EFF entry) selects out of d.CryptFilters. "Identity" and the empty
+// string both mean "do not encrypt", returning a nil filter and no error.
+func (d *StdEncryptDict) cryptFilterFor(name string) (CryptFilter, error) {
+	if name == "" || name == "Identity" {
+		return nil, nil
+	}
+	cf, ok := d.CryptFilters[name]
+	if !ok {
+		return nil, errors.New("security: crypt filter " + name + " not present in CF dictionary")
+	}
+	return cf, nil
+}
+
+// StreamCryptFilter returns the CryptFilter selected by the StmF entry.
+func (d *StdEncryptDict) StreamCryptFilter() (CryptFilter, error) {
+	return d.cryptFilterFor(d.StmF)
+}
+
+// StringCryptFilter returns the CryptFilter selected by the StrF entry.
+func (d *StdEncryptDict) StringCryptFilter() (CryptFilter, error) {
+	return d.cryptFilterFor(d.StrF)
+}
+
+// EmbeddedFileCryptFilter returns the CryptFilter selected by the EFF entry.
+// Per the spec, an unset EFF falls back to StmF.
+func (d *StdEncryptDict) EmbeddedFileCryptFilter() (CryptFilter, error) {
+	if d.EFF == "" {
+		return d.StreamCryptFilter()
+	}
+	return d.cryptFilterFor(d.EFF)
+}
+
+// encryptStreamWith and its three siblings below are shared by stdHandlerR4
+// and stdHandlerR6: they resolve the relevant crypt filter from d and
+// delegate to it, leaving data untouched when the dictionary selects
+// Identity (no CryptFilters configured, as with a plain R4 document that
+// never declared a CF entry).
+func encryptStreamWith(d *StdEncryptDict, objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	cf, err := d.StreamCryptFilter()
+	if err != nil || cf == nil {
+		return data, err
+	}
+	return cf.EncryptStream(objNum, objGen, fkey, data)
+}
+
+func decryptStreamWith(d *StdEncryptDict, objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	cf, err := d.StreamCryptFilter()
+	if err != nil || cf == nil {
+		return data, err
+	}
+	return cf.DecryptStream(objNum, objGen, fkey, data)
+}
+
+func encryptStringWith(d *StdEncryptDict, objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	cf, err := d.StringCryptFilter()
+	if err != nil || cf == nil {
+		return data, err
+	}
+	return cf.EncryptString(objNum, objGen, fkey, data)
+}
+
+func decryptStringWith(d *StdEncryptDict, objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	cf, err := d.StringCryptFilter()
+	if err != nil || cf == nil {
+		return data, err
+	}
+	return cf.DecryptString(objNum, objGen, fkey, data)
+}
+
+// filterV2 is the legacy RC4-based crypt filter.
+type filterV2 struct {
+	length int
+}
+
+func (f filterV2) Name() string { return "V2" }
+func (f filterV2) KeySize() int { return f.length }
+
+func (f filterV2) EncryptStream(objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return f.crypt(objNum, objGen, fkey, data)
+}
+
+func (f filterV2) DecryptStream(objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return f.crypt(objNum, objGen, fkey, data)
+}
+
+func (f filterV2) EncryptString(objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return f.crypt(objNum, objGen, fkey, data)
+}
+
+func (f filterV2) DecryptString(objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return f.crypt(objNum, objGen, fkey, data)
+}
+
+// crypt runs RC4 with the per-object key; RC4 is its own inverse so the
+// same code path serves both encryption and decryption.
+func (f filterV2) crypt(objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	key := makeObjectKey(fkey, objNum, objGen, false)
+	defer Zero(key)
+	ciph, err := rc4.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data))
+	ciph.XORKeyStream(out, data)
+	return out, nil
+}
+
+// filterAESCBC is the AES-CBC crypt filter shared by AESV2 (R4, 128-bit,
+// per-object derived key) and AESV3 (R5/R6, 256-bit, file key used
+// directly). Both store a random 16-byte IV ahead of the ciphertext.
+type filterAESCBC struct {
+	name         string
+	keySize      int
+	perObjectKey bool
+}
+
+func (f filterAESCBC) Name() string { return f.name }
+func (f filterAESCBC) KeySize() int { return f.keySize }
+
+func (f filterAESCBC) objectKey(objNum, objGen int64, fkey []byte) []byte {
+	if f.perObjectKey {
+		return makeObjectKey(fkey, objNum, objGen, true)
+	}
+	return fkey
+}
+
+func (f filterAESCBC) EncryptStream(objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return f.encrypt(objNum, objGen, fkey, data)
+}
+
+func (f filterAESCBC) DecryptStream(objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return f.decrypt(objNum, objGen, fkey, data)
+}
+
+func (f filterAESCBC) EncryptString(objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return f.encrypt(objNum, objGen, fkey, data)
+}
+
+func (f filterAESCBC) DecryptString(objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return f.decrypt(objNum, objGen, fkey, data)
+}
+
+func (f filterAESCBC) encrypt(objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	key := f.objectKey(objNum, objGen, fkey)
+	if f.perObjectKey {
+		defer Zero(key)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	padded := pkcs7Pad(data, aes.BlockSize)
+	out := make([]byte, aes.BlockSize+len(padded))
+	copy(out, iv)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out[aes.BlockSize:], padded)
+	return out, nil
+}
+
+func (f filterAESCBC) decrypt(objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	if len(data) < aes.BlockSize {
+		return nil, errors.New("security: ciphertext shorter than IV")
+	}
+	iv, ciphertext := data[:aes.BlockSize], data[aes.BlockSize:]
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, errors.New("security: ciphertext not a multiple of the AES block size")
+	}
+
+	key := f.objectKey(objNum, objGen, fkey)
+	if f.perObjectKey {
+		defer Zero(key)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plain := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, ciphertext)
+	return pkcs7Unpad(plain)
+}
+
+// filterAESGCM is the non-standard "AESV3GCM" authenticated crypt filter.
+// Like AESV2, every object is sealed under its own key, derived from the
+// file encryption key via makeObjectKeyAES256, so a nonce collision (however
+// unlikely with a 12-byte random nonce) only ever compromises the one
+// colliding object. Its output is a 12-byte nonce, followed by the
+// ciphertext, followed by a 16-byte authentication tag, so that tampering
+// with an encrypted stream or string is detected as a decryption error
+// instead of silently producing garbage plaintext.
+type filterAESGCM struct{}
+
+func (filterAESGCM) Name() string { return "AESV3GCM" }
+func (filterAESGCM) KeySize() int { return 32 }
+
+func (f filterAESGCM) EncryptStream(objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return f.seal(objNum, objGen, fkey, data)
+}
+
+func (f filterAESGCM) DecryptStream(objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return f.open(objNum, objGen, fkey, data)
+}
+
+func (f filterAESGCM) EncryptString(objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return f.seal(objNum, objGen, fkey, data)
+}
+
+func (f filterAESGCM) DecryptString(objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return f.open(objNum, objGen, fkey, data)
+}
+
+func (filterAESGCM) seal(objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	key := makeObjectKeyAES256(fkey, objNum, objGen)
+	defer Zero(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+func (filterAESGCM) open(objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	key := makeObjectKeyAES256(fkey, objNum, objGen)
+	defer Zero(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("security: AESV3GCM ciphertext shorter than the nonce")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
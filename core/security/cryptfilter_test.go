@@ -0,0 +1,103 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package security
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestCryptFiltersRoundTrip exercises every filter registered in
+// cryptFilterRegistry, confirming EncryptStream/EncryptString round-trip
+// through the matching Decrypt method for a representative file key and a
+// couple of distinct object numbers (AESV2 and AESV3GCM derive a per-object
+// key, so objNum/objGen must actually participate in the round trip).
+func TestCryptFiltersRoundTrip(t *testing.T) {
+	plain := []byte("the quick brown fox jumps over the lazy dog")
+
+	tests := []struct {
+		name    string
+		keyLen  int
+		factory func(length int) CryptFilter
+	}{
+		{"V2", 16, cryptFilterRegistry["V2"]},
+		{"AESV2", 16, cryptFilterRegistry["AESV2"]},
+		{"AESV3", 32, cryptFilterRegistry["AESV3"]},
+		{"AESV3GCM", 32, cryptFilterRegistry["AESV3GCM"]},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cf := tc.factory(tc.keyLen)
+			if cf.Name() != tc.name {
+				t.Fatalf("Name() = %q, want %q", cf.Name(), tc.name)
+			}
+
+			fkey := bytes.Repeat([]byte{0x42}, tc.keyLen)
+
+			for _, obj := range []struct{ num, gen int64 }{{1, 0}, {7, 2}} {
+				ciphStream, err := cf.EncryptStream(obj.num, obj.gen, fkey, plain)
+				if err != nil {
+					t.Fatalf("EncryptStream(%d, %d): %v", obj.num, obj.gen, err)
+				}
+				gotStream, err := cf.DecryptStream(obj.num, obj.gen, fkey, ciphStream)
+				if err != nil {
+					t.Fatalf("DecryptStream(%d, %d): %v", obj.num, obj.gen, err)
+				}
+				if !bytes.Equal(gotStream, plain) {
+					t.Errorf("stream round trip (%d, %d) = %q, want %q", obj.num, obj.gen, gotStream, plain)
+				}
+
+				ciphString, err := cf.EncryptString(obj.num, obj.gen, fkey, plain)
+				if err != nil {
+					t.Fatalf("EncryptString(%d, %d): %v", obj.num, obj.gen, err)
+				}
+				gotString, err := cf.DecryptString(obj.num, obj.gen, fkey, ciphString)
+				if err != nil {
+					t.Fatalf("DecryptString(%d, %d): %v", obj.num, obj.gen, err)
+				}
+				if !bytes.Equal(gotString, plain) {
+					t.Errorf("string round trip (%d, %d) = %q, want %q", obj.num, obj.gen, gotString, plain)
+				}
+			}
+		})
+	}
+}
+
+// TestFilterAESGCMDetectsTampering confirms the authenticated filter rejects
+// a flipped ciphertext byte instead of silently returning garbage plaintext.
+func TestFilterAESGCMDetectsTampering(t *testing.T) {
+	f := filterAESGCM{}
+	fkey := bytes.Repeat([]byte{0x11}, 32)
+
+	ciph, err := f.EncryptStream(3, 0, fkey, []byte("secret"))
+	if err != nil {
+		t.Fatalf("EncryptStream: %v", err)
+	}
+	ciph[len(ciph)-1] ^= 0xff
+
+	if _, err := f.DecryptStream(3, 0, fkey, ciph); err == nil {
+		t.Error("DecryptStream accepted tampered ciphertext, want error")
+	}
+}
+
+// TestFilterAESGCMPerObjectKey confirms that the same plaintext sealed for
+// two different objects under the same file key does not share a key: with
+// a fixed nonce-independent oracle this would be easiest to show by
+// decrypting object A's ciphertext as if it were object B's, which must
+// fail now that each object derives its own key (see makeObjectKeyAES256).
+func TestFilterAESGCMPerObjectKey(t *testing.T) {
+	f := filterAESGCM{}
+	fkey := bytes.Repeat([]byte{0x22}, 32)
+
+	ciph, err := f.EncryptStream(1, 0, fkey, []byte("secret"))
+	if err != nil {
+		t.Fatalf("EncryptStream: %v", err)
+	}
+	if _, err := f.DecryptStream(2, 0, fkey, ciph); err == nil {
+		t.Error("DecryptStream succeeded with the wrong object's key, want error")
+	}
+}
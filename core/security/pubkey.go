@@ -0,0 +1,436 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package security
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"math/big"
+
+	"github.com/snwfdhmp/unipdf/common"
+)
+
+var _ StdHandler = &PubKeyHandler{}
+
+// Decrypter unwraps a PKCS#7 key transport envelope addressed to a single
+// recipient certificate. It is satisfied by *RSADecrypter for software-only
+// use, and can be implemented against a PKCS#11 token or other
+// hardware-backed key store so the private key never needs to leave the
+// device.
+type Decrypter interface {
+	// Certificate returns the recipient certificate this Decrypter holds the
+	// private key for.
+	Certificate() *x509.Certificate
+	// Decrypt unwraps an RSAES-PKCS1-v1_5 encrypted key addressed to
+	// Certificate's public key, returning the plaintext key.
+	Decrypt(encryptedKey []byte) ([]byte, error)
+}
+
+// RSADecrypter adapts an *rsa.PrivateKey and its certificate to the
+// Decrypter interface.
+type RSADecrypter struct {
+	Cert *x509.Certificate
+	Key  *rsa.PrivateKey
+}
+
+var _ Decrypter = (*RSADecrypter)(nil)
+
+// Certificate implements the Decrypter interface.
+func (d *RSADecrypter) Certificate() *x509.Certificate {
+	return d.Cert
+}
+
+// Decrypt implements the Decrypter interface.
+func (d *RSADecrypter) Decrypt(encryptedKey []byte) ([]byte, error) {
+	return rsa.DecryptPKCS1v15(rand.Reader, d.Key, encryptedKey)
+}
+
+// seedLen is the length, in bytes, of the random seed embedded in each
+// recipient's enveloped data.
+const seedLen = 20
+
+// permLen is the length, in bytes, of the permission bits appended to the
+// seed before it is encrypted to each recipient.
+const permLen = 4
+
+// PubKeyHandler implements the PDF Public-Key security handler
+// (Adobe.PubSec, /Filter adbe.pkcs7.s4 and adbe.pkcs7.s5). Unlike
+// stdHandlerR4 and stdHandlerR6, there is no single password: a random seed
+// and the permission bits are wrapped once per recipient as a PKCS#7
+// EnvelopedData blob, each encrypted to one recipient's X.509 certificate,
+// and stored in the encryption dictionary's Recipients entries. The file
+// encryption key is derived from the seed and those blobs (see
+// deriveFileKey).
+type PubKeyHandler struct {
+	// Certs are the recipient certificates new documents are encrypted for.
+	Certs []*x509.Certificate
+	// Decrypter unwraps the Recipients entry addressed to the local
+	// identity when decrypting a document. It may be nil when only
+	// encrypting.
+	Decrypter Decrypter
+	// AES256 selects the adbe.pkcs7.s5 (AES-256) variant. When false, the
+	// legacy adbe.pkcs7.s4 (AES-128) variant is used.
+	AES256 bool
+}
+
+// NewPubKeyHandler creates a Public-Key security handler that encrypts new
+// documents to certs.
+func NewPubKeyHandler(aes256 bool, certs ...*x509.Certificate) *PubKeyHandler {
+	return &PubKeyHandler{Certs: certs, AES256: aes256}
+}
+
+// NewPubKeyDecryptHandler creates a Public-Key security handler that
+// decrypts documents using dec to unwrap the Recipients entry addressed to
+// it.
+func NewPubKeyDecryptHandler(dec Decrypter, aes256 bool) *PubKeyHandler {
+	return &PubKeyHandler{Decrypter: dec, AES256: aes256}
+}
+
+// GenerateParams builds one PKCS#7 EnvelopedData blob per recipient
+// certificate and derives the file encryption key from them. opass and
+// upass are ignored: the Public-Key handler has no passwords.
+func (h *PubKeyHandler) GenerateParams(d *StdEncryptDict, _, _ []byte) ([]byte, error) {
+	if len(h.Certs) == 0 {
+		return nil, errors.New("security: no recipient certificates configured")
+	}
+
+	seed := make([]byte, seedLen)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	defer Zero(seed)
+
+	plain := make([]byte, seedLen+permLen)
+	copy(plain, seed)
+	binary.LittleEndian.PutUint32(plain[seedLen:], uint32(d.P))
+	defer Zero(plain)
+
+	recipients := make([][]byte, len(h.Certs))
+	for i, cert := range h.Certs {
+		blob, err := encryptEnvelopedData(cert, plain, h.AES256)
+		if err != nil {
+			common.Log.Debug("ERROR: Error building Recipients entry for encryption (%s)", err)
+			return nil, err
+		}
+		recipients[i] = blob
+	}
+	d.Recipients = recipients
+
+	return h.deriveFileKey(seed, recipients, d.EncryptMetadata), nil
+}
+
+// EncryptStream encrypts a stream's raw bytes for the indirect object
+// objNum/objGen, through the CryptFilter d's StmF entry selects.
+func (h *PubKeyHandler) EncryptStream(d *StdEncryptDict, objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return encryptStreamWith(d, objNum, objGen, fkey, data)
+}
+
+// DecryptStream reverses EncryptStream.
+func (h *PubKeyHandler) DecryptStream(d *StdEncryptDict, objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return decryptStreamWith(d, objNum, objGen, fkey, data)
+}
+
+// EncryptString encrypts a string's raw bytes for the indirect object
+// objNum/objGen, through the CryptFilter d's StrF entry selects.
+func (h *PubKeyHandler) EncryptString(d *StdEncryptDict, objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return encryptStringWith(d, objNum, objGen, fkey, data)
+}
+
+// DecryptString reverses EncryptString.
+func (h *PubKeyHandler) DecryptString(d *StdEncryptDict, objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return decryptStringWith(d, objNum, objGen, fkey, data)
+}
+
+// Authenticate implements the StdHandler interface. pass is ignored: the
+// recipient is identified by its certificate, not a password.
+func (h *PubKeyHandler) Authenticate(d *StdEncryptDict, _ []byte) ([]byte, Permissions, error) {
+	if h.Decrypter == nil {
+		return nil, 0, errors.New("security: no decrypter configured for public-key handler")
+	}
+	cert := h.Decrypter.Certificate()
+
+	for _, blob := range d.Recipients {
+		plain, err := decryptEnvelopedData(blob, cert, h.Decrypter)
+		if err != nil || len(plain) < seedLen+permLen {
+			continue
+		}
+		seed := plain[0:seedLen]
+		p := binary.LittleEndian.Uint32(plain[seedLen : seedLen+permLen])
+		key := h.deriveFileKey(seed, d.Recipients, d.EncryptMetadata)
+		Zero(plain)
+		return key, Permissions(p), nil
+	}
+	// None of the Recipients entries were addressed to cert, or none could
+	// be decrypted: cannot view the file.
+	return nil, 0, nil
+}
+
+// deriveFileKey computes the file encryption key from the seed and the raw
+// bytes of every Recipients entry: SHA-1 for adbe.pkcs7.s4, or SHA-256 for
+// the AES-256 adbe.pkcs7.s5 variant, with "\xff\xff\xff\xff" appended when
+// metadata is left unencrypted.
+func (h *PubKeyHandler) deriveFileKey(seed []byte, recipients [][]byte, encryptMetadata bool) []byte {
+	var buf bytes.Buffer
+	buf.Write(seed)
+	for _, r := range recipients {
+		buf.Write(r)
+	}
+	if !encryptMetadata {
+		buf.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	}
+
+	if h.AES256 {
+		sum := sha256.Sum256(buf.Bytes())
+		return sum[:]
+	}
+	sum := sha1.Sum(buf.Bytes())
+	return sum[0:16]
+}
+
+// The ASN.1 structures and OIDs below implement just enough of PKCS#7/CMS
+// (RFC 2315) to wrap and unwrap the single-recipient-per-blob, RSA key
+// transport EnvelopedData structures Acrobat reads and writes for the
+// Public-Key security handler.
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidAES128CBC     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES256CBC     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// contentInfo.Content must hold a [0] EXPLICIT wrapper around the
+// envelopedData SEQUENCE. encoding/asn1 ignores tag options on a RawValue
+// field once FullBytes is set directly, so the wrapper is built by hand with
+// wrapExplicit before marshaling rather than relying on the struct tag
+// below (kept only as documentation of the wire format).
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+// wrapExplicit wraps der in an ASN.1 [tag] EXPLICIT context-specific,
+// constructed header per X.690 8.14, since encoding/asn1 cannot produce this
+// wrapping itself for a RawValue field (see contentInfo above).
+func wrapExplicit(tag byte, der []byte) []byte {
+	return append(append([]byte{0xa0 | tag}, asn1Length(len(der))...), der...)
+}
+
+// asn1Length DER-encodes n as an ASN.1 length octet sequence.
+func asn1Length(n int) []byte {
+	if n < 128 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for v := n; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type recipientInfo struct {
+	Version         int
+	IssuerAndSerial issuerAndSerial
+	KeyEncAlgo      pkix.AlgorithmIdentifier
+	EncryptedKey    []byte
+}
+
+type encryptedContentInfo struct {
+	ContentType    asn1.ObjectIdentifier
+	ContentEncAlgo pkix.AlgorithmIdentifier
+	EncryptedData  []byte `asn1:"tag:0,optional,implicit"`
+}
+
+type envelopedData struct {
+	Version       int
+	Recipients    []recipientInfo `asn1:"set"`
+	EncryptedInfo encryptedContentInfo
+}
+
+// encryptEnvelopedData encrypts plain with a fresh AES content key (128-bit
+// for adbe.pkcs7.s4, 256-bit for adbe.pkcs7.s5 when aes256 is set), wraps
+// that key to cert's RSA public key, and returns the DER encoding of the
+// resulting PKCS#7 EnvelopedData ContentInfo.
+func encryptEnvelopedData(cert *x509.Certificate, plain []byte, aes256 bool) ([]byte, error) {
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("security: only RSA recipient certificates are supported")
+	}
+
+	contentEncAlgo := oidAES128CBC
+	keySize := 16
+	if aes256 {
+		contentEncAlgo = oidAES256CBC
+		keySize = 32
+	}
+
+	contentKey := make([]byte, keySize)
+	if _, err := rand.Read(contentKey); err != nil {
+		return nil, err
+	}
+	defer Zero(contentKey)
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	padded := pkcs7Pad(plain, aes.BlockSize)
+	ciphertext := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+
+	encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, contentKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ivParams, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+
+	ed := envelopedData{
+		Version: 0,
+		Recipients: []recipientInfo{{
+			Version: 0,
+			IssuerAndSerial: issuerAndSerial{
+				Issuer: asn1.RawValue{FullBytes: cert.RawIssuer},
+				Serial: cert.SerialNumber,
+			},
+			KeyEncAlgo:   pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption},
+			EncryptedKey: encryptedKey,
+		}},
+		EncryptedInfo: encryptedContentInfo{
+			ContentType: oidData,
+			ContentEncAlgo: pkix.AlgorithmIdentifier{
+				Algorithm:  contentEncAlgo,
+				Parameters: asn1.RawValue{FullBytes: ivParams},
+			},
+			EncryptedData: ciphertext,
+		},
+	}
+
+	inner, err := asn1.Marshal(ed)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{
+		ContentType: oidEnvelopedData,
+		Content:     asn1.RawValue{FullBytes: wrapExplicit(0, inner)},
+	})
+}
+
+// decryptEnvelopedData parses blob as a PKCS#7 EnvelopedData ContentInfo,
+// unwraps the recipientInfo matching cert via dec, and returns the
+// decrypted content.
+func decryptEnvelopedData(blob []byte, cert *x509.Certificate, dec Decrypter) ([]byte, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(blob, &ci); err != nil {
+		return nil, err
+	}
+	if !ci.ContentType.Equal(oidEnvelopedData) {
+		return nil, errors.New("security: not a PKCS#7 EnvelopedData blob")
+	}
+
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+		return nil, err
+	}
+
+	var encryptedKey []byte
+	for _, ri := range ed.Recipients {
+		if bytes.Equal(ri.IssuerAndSerial.Issuer.FullBytes, cert.RawIssuer) &&
+			ri.IssuerAndSerial.Serial.Cmp(cert.SerialNumber) == 0 {
+			encryptedKey = ri.EncryptedKey
+			break
+		}
+	}
+	if encryptedKey == nil {
+		return nil, errors.New("security: no recipientInfo addressed to the given certificate")
+	}
+
+	algo := ed.EncryptedInfo.ContentEncAlgo.Algorithm
+	var wantKeySize int
+	switch {
+	case algo.Equal(oidAES128CBC):
+		wantKeySize = 16
+	case algo.Equal(oidAES256CBC):
+		wantKeySize = 32
+	default:
+		return nil, errors.New("security: unsupported content encryption algorithm " + algo.String())
+	}
+
+	contentKey, err := dec.Decrypt(encryptedKey)
+	if err != nil {
+		return nil, err
+	}
+	defer Zero(contentKey)
+	if len(contentKey) != wantKeySize {
+		return nil, errors.New("security: content key length does not match the declared content encryption algorithm")
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(ed.EncryptedInfo.ContentEncAlgo.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := ed.EncryptedInfo.EncryptedData
+	if len(ciphertext) == 0 || len(ciphertext)%aes.BlockSize != 0 {
+		return nil, errors.New("security: invalid EncryptedContent length")
+	}
+	plain := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, ciphertext)
+	return pkcs7Unpad(plain)
+}
+
+// pkcs7Pad pads data to a multiple of blockSize per RFC 2315's padding rule.
+func pkcs7Pad(data []byte, blockSize int) []byte {
+	n := blockSize - len(data)%blockSize
+	padded := make([]byte, len(data)+n)
+	copy(padded, data)
+	for i := len(data); i < len(padded); i++ {
+		padded[i] = byte(n)
+	}
+	return padded
+}
+
+// pkcs7Unpad removes PKCS#7 padding added by pkcs7Pad. It checks only that
+// the last byte gives a pad length between 1 and len(data); the values of the
+// other padding bytes are not checked.
+func pkcs7Unpad(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("security: empty padded content")
+	}
+	n := int(data[len(data)-1])
+	if n == 0 || n > len(data) {
+		return nil, errors.New("security: invalid PKCS#7 padding")
+	}
+	return data[:len(data)-n], nil
+}
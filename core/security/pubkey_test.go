@@ -0,0 +1,111 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package security
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+)
+
+// selfSignedCert generates an ephemeral RSA key and a matching self-signed
+// certificate for use as a test-only recipient identity.
+func selfSignedCert(t *testing.T) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "unipdf-old test recipient"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate: %v", err)
+	}
+	return cert, key
+}
+
+func TestPubKeyHandlerGenerateParamsAuthenticateRoundTrip(t *testing.T) {
+	cert, key := selfSignedCert(t)
+
+	enc := NewPubKeyHandler(false, cert)
+	d := &StdEncryptDict{R: 4, P: PermPrinting, EncryptMetadata: true}
+	fkey, err := enc.GenerateParams(d, nil, nil)
+	if err != nil {
+		t.Fatalf("GenerateParams: %v", err)
+	}
+	if len(fkey) != 16 {
+		t.Fatalf("GenerateParams returned a %d-byte key, want 16 (adbe.pkcs7.s4)", len(fkey))
+	}
+	if len(d.Recipients) != 1 {
+		t.Fatalf("GenerateParams set %d Recipients entries, want 1", len(d.Recipients))
+	}
+
+	dec := NewPubKeyDecryptHandler(&RSADecrypter{Cert: cert, Key: key}, false)
+	gotKey, perm, err := dec.Authenticate(d, nil)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if !bytes.Equal(gotKey, fkey) {
+		t.Errorf("Authenticate key = %x, want %x", gotKey, fkey)
+	}
+	if perm != d.P {
+		t.Errorf("Authenticate perm = %v, want %v", perm, d.P)
+	}
+}
+
+func TestPubKeyHandlerAES256(t *testing.T) {
+	cert, key := selfSignedCert(t)
+
+	enc := NewPubKeyHandler(true, cert)
+	d := &StdEncryptDict{R: 6, P: PermPrinting, EncryptMetadata: true}
+	fkey, err := enc.GenerateParams(d, nil, nil)
+	if err != nil {
+		t.Fatalf("GenerateParams: %v", err)
+	}
+	if len(fkey) != 32 {
+		t.Fatalf("GenerateParams returned a %d-byte key, want 32 (adbe.pkcs7.s5)", len(fkey))
+	}
+
+	dec := NewPubKeyDecryptHandler(&RSADecrypter{Cert: cert, Key: key}, true)
+	gotKey, _, err := dec.Authenticate(d, nil)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if !bytes.Equal(gotKey, fkey) {
+		t.Errorf("Authenticate key = %x, want %x", gotKey, fkey)
+	}
+}
+
+func TestPubKeyHandlerWrongRecipient(t *testing.T) {
+	cert, _ := selfSignedCert(t)
+	otherCert, otherKey := selfSignedCert(t)
+
+	enc := NewPubKeyHandler(false, cert)
+	d := &StdEncryptDict{R: 4, P: PermPrinting, EncryptMetadata: true}
+	if _, err := enc.GenerateParams(d, nil, nil); err != nil {
+		t.Fatalf("GenerateParams: %v", err)
+	}
+
+	dec := NewPubKeyDecryptHandler(&RSADecrypter{Cert: otherCert, Key: otherKey}, false)
+	key, _, err := dec.Authenticate(d, nil)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if key != nil {
+		t.Errorf("Authenticate with an unaddressed certificate returned a key, want nil")
+	}
+}
@@ -16,7 +16,10 @@ import (
 	"github.com/snwfdhmp/unipdf/common"
 )
 
-var _ StdHandler = stdHandlerR4{}
+var (
+	_ StdHandler = stdHandlerR4{}
+	_ KeyWiper   = stdHandlerR4{}
+)
 
 const padding = "\x28\xBF\x4E\x5E\x4E\x75\x8A\x41\x64\x00\x4E\x56\xFF" +
 	"\xFA\x01\x08\x2E\x2E\x00\xB6\xD0\x68\x3E\x80\x2F\x0C" +
@@ -36,6 +39,36 @@ type stdHandlerR4 struct {
 	ID0    string
 }
 
+// Wipe zeroizes key in place. It implements the KeyWiper interface so callers
+// can explicitly scrub the file encryption key once a document is closed.
+func (stdHandlerR4) Wipe(key []byte) {
+	Zero(key)
+}
+
+// EncryptStream encrypts a stream's raw bytes for the indirect object
+// objNum/objGen, through the CryptFilter d's StmF entry selects (RC4/AES-CBC
+// for a V4 dictionary with a CF entry; falling back to returning data
+// unchanged for a pre-V4 dictionary that never declares one).
+func (stdHandlerR4) EncryptStream(d *StdEncryptDict, objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return encryptStreamWith(d, objNum, objGen, fkey, data)
+}
+
+// DecryptStream reverses EncryptStream.
+func (stdHandlerR4) DecryptStream(d *StdEncryptDict, objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return decryptStreamWith(d, objNum, objGen, fkey, data)
+}
+
+// EncryptString encrypts a string's raw bytes for the indirect object
+// objNum/objGen, through the CryptFilter d's StrF entry selects.
+func (stdHandlerR4) EncryptString(d *StdEncryptDict, objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return encryptStringWith(d, objNum, objGen, fkey, data)
+}
+
+// DecryptString reverses EncryptString.
+func (stdHandlerR4) DecryptString(d *StdEncryptDict, objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return decryptStringWith(d, objNum, objGen, fkey, data)
+}
+
 func (stdHandlerR4) paddedPass(pass []byte) []byte {
 	key := make([]byte, 32)
 	i := copy(key, pass)
@@ -49,6 +82,7 @@ func (stdHandlerR4) paddedPass(pass []byte) []byte {
 func (sh stdHandlerR4) alg2(d *StdEncryptDict, pass []byte) []byte {
 	common.Log.Trace("alg2")
 	key := sh.paddedPass(pass)
+	defer Zero(key)
 
 	h := md5.New()
 	h.Write(key)
@@ -76,7 +110,9 @@ func (sh stdHandlerR4) alg2(d *StdEncryptDict, pass []byte) []byte {
 		for i := 0; i < 50; i++ {
 			h.Reset()
 			h.Write(hashb[0 : sh.Length/8])
+			prev := hashb
 			hashb = h.Sum(nil)
+			Zero(prev)
 		}
 	}
 
@@ -91,6 +127,7 @@ func (sh stdHandlerR4) alg2(d *StdEncryptDict, pass []byte) []byte {
 func (sh stdHandlerR4) alg3Key(R int, pass []byte) []byte {
 	h := md5.New()
 	okey := sh.paddedPass(pass)
+	defer Zero(okey)
 	h.Write(okey)
 
 	if R >= 3 {
@@ -98,6 +135,7 @@ func (sh stdHandlerR4) alg3Key(R int, pass []byte) []byte {
 			hashb := h.Sum(nil)
 			h = md5.New()
 			h.Write(hashb)
+			Zero(hashb)
 		}
 	}
 
@@ -118,6 +156,7 @@ func (sh stdHandlerR4) alg3(R int, upass, opass []byte) ([]byte, error) {
 	} else {
 		encKey = sh.alg3Key(R, upass)
 	}
+	defer Zero(encKey)
 
 	ociph, err := rc4.NewCipher(encKey)
 	if err != nil {
@@ -125,11 +164,13 @@ func (sh stdHandlerR4) alg3(R int, upass, opass []byte) ([]byte, error) {
 	}
 
 	ukey := sh.paddedPass(upass)
+	defer Zero(ukey)
 	encrypted := make([]byte, len(ukey))
 	ociph.XORKeyStream(encrypted, ukey)
 
 	if R >= 3 {
 		encKey2 := make([]byte, len(encKey))
+		defer Zero(encKey2)
 		for i := 0; i < 19; i++ {
 			for j := 0; j < len(encKey); j++ {
 				encKey2[j] = encKey[j] ^ byte(i+1)
@@ -163,6 +204,7 @@ func (sh stdHandlerR4) alg5(ekey []byte, upass []byte) ([]byte, error) {
 	h.Write([]byte(padding))
 	h.Write([]byte(sh.ID0))
 	hash := h.Sum(nil)
+	defer Zero(hash)
 
 	common.Log.Trace("alg5")
 	common.Log.Trace("ekey: % x", ekey)
@@ -177,6 +219,7 @@ func (sh stdHandlerR4) alg5(ekey []byte, upass []byte) ([]byte, error) {
 		return nil, errors.New("failed rc4 ciph")
 	}
 	encrypted := make([]byte, 16)
+	defer Zero(encrypted)
 	ciph.XORKeyStream(encrypted, hash)
 
 	// Do the following 19 times: Take the output from the previous
@@ -186,6 +229,7 @@ func (sh stdHandlerR4) alg5(ekey []byte, upass []byte) ([]byte, error) {
 	// (a) and performing an XOR (exclusive or) operation between that
 	// byte and the single-byte value of the iteration counter (from 1 to 19).
 	ekey2 := make([]byte, len(ekey))
+	defer Zero(ekey2)
 	for i := 0; i < 19; i++ {
 		for j := 0; j < len(ekey); j++ {
 			ekey2[j] = ekey[j] ^ byte(i+1)
@@ -227,11 +271,14 @@ func (sh stdHandlerR4) alg6(d *StdEncryptDict, upass []byte) ([]byte, error) {
 	} else if d.R >= 3 {
 		uo, err = sh.alg5(ekey, upass)
 	} else {
+		Zero(ekey)
 		return nil, errors.New("invalid R")
 	}
 	if err != nil {
+		Zero(ekey)
 		return nil, err
 	}
+	defer Zero(uo)
 
 	common.Log.Trace("check: % x == % x ?", string(uo), string(d.U))
 
@@ -249,6 +296,7 @@ func (sh stdHandlerR4) alg6(d *StdEncryptDict, upass []byte) ([]byte, error) {
 	}
 
 	if !bytes.Equal(uGen, uDoc) {
+		Zero(ekey)
 		return nil, nil
 	}
 	return ekey, nil
@@ -258,8 +306,10 @@ func (sh stdHandlerR4) alg6(d *StdEncryptDict, upass []byte) ([]byte, error) {
 // It returns an nil key in case authentication failed.
 func (sh stdHandlerR4) alg7(d *StdEncryptDict, opass []byte) ([]byte, error) {
 	encKey := sh.alg3Key(d.R, opass)
+	defer Zero(encKey)
 
 	decrypted := make([]byte, len(d.O))
+	defer Zero(decrypted)
 	if d.R == 2 {
 		ciph, err := rc4.NewCipher(encKey)
 		if err != nil {
@@ -268,18 +318,19 @@ func (sh stdHandlerR4) alg7(d *StdEncryptDict, opass []byte) ([]byte, error) {
 		ciph.XORKeyStream(decrypted, d.O)
 	} else if d.R >= 3 {
 		s := append([]byte{}, d.O...)
+		defer Zero(s)
+		newKey := make([]byte, len(encKey))
+		defer Zero(newKey)
 		for i := 0; i < 20; i++ {
-			//newKey := encKey
-			newKey := append([]byte{}, encKey...)
 			for j := 0; j < len(encKey); j++ {
-				newKey[j] ^= byte(19 - i)
+				newKey[j] = encKey[j] ^ byte(19-i)
 			}
 			ciph, err := rc4.NewCipher(newKey)
 			if err != nil {
 				return nil, errors.New("failed cipher")
 			}
 			ciph.XORKeyStream(decrypted, s)
-			s = append([]byte{}, decrypted...)
+			copy(s, decrypted)
 		}
 	} else {
 		return nil, errors.New("invalid R")
@@ -310,6 +361,7 @@ func (sh stdHandlerR4) GenerateParams(d *StdEncryptDict, opass, upass []byte) ([
 	U, err := sh.alg5(ekey, upass)
 	if err != nil {
 		common.Log.Debug("ERROR: Error generating O for encryption (%s)", err)
+		Zero(ekey)
 		return nil, err
 	}
 	d.U = U
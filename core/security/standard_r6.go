@@ -0,0 +1,332 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package security
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"math/big"
+
+	"golang.org/x/text/secure/precis"
+
+	"github.com/snwfdhmp/unipdf/common"
+)
+
+var (
+	_ StdHandler = stdHandlerR6{}
+	_ KeyWiper   = stdHandlerR6{}
+)
+
+// NewHandlerR6 creates a new standard security handler for R=6 (PDF 2.0 / ISO 32000-2),
+// which uses AES-256 and SHA-256/384/512 to generate encryption parameters.
+func NewHandlerR6() StdHandler {
+	return stdHandlerR6{}
+}
+
+// stdHandlerR6 is a standard security handler for R=6, as described in ISO 32000-2
+// Annex A. Unlike stdHandlerR4, it requires no state from the trailer or the
+// encryption dictionary's Length entry: the file encryption key is always 32 bytes
+// and is recovered directly from the U/O/UE/OE entries.
+type stdHandlerR6 struct{}
+
+// Wipe zeroizes key in place. It implements the KeyWiper interface so callers
+// can explicitly scrub the file encryption key once a document is closed.
+func (stdHandlerR6) Wipe(key []byte) {
+	Zero(key)
+}
+
+// EncryptStream encrypts a stream's raw bytes for the indirect object
+// objNum/objGen, through the CryptFilter d's StmF entry selects (AESV3 or
+// AESV3GCM for a V5/R6 dictionary).
+func (stdHandlerR6) EncryptStream(d *StdEncryptDict, objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return encryptStreamWith(d, objNum, objGen, fkey, data)
+}
+
+// DecryptStream reverses EncryptStream.
+func (stdHandlerR6) DecryptStream(d *StdEncryptDict, objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return decryptStreamWith(d, objNum, objGen, fkey, data)
+}
+
+// EncryptString encrypts a string's raw bytes for the indirect object
+// objNum/objGen, through the CryptFilter d's StrF entry selects.
+func (stdHandlerR6) EncryptString(d *StdEncryptDict, objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return encryptStringWith(d, objNum, objGen, fkey, data)
+}
+
+// DecryptString reverses EncryptString.
+func (stdHandlerR6) DecryptString(d *StdEncryptDict, objNum, objGen int64, fkey, data []byte) ([]byte, error) {
+	return decryptStringWith(d, objNum, objGen, fkey, data)
+}
+
+// processPass normalizes pass using SASLprep (RFC 4013) and truncates the result
+// to 127 bytes, per ISO 32000-2 7.6.4.3.4.
+func (stdHandlerR6) processPass(pass []byte) []byte {
+	out, err := precis.OpaqueString.Bytes(pass)
+	if err != nil {
+		// Fall back to the raw password if it cannot be profiled;
+		// this matches how non-conformant passwords are handled in practice.
+		out = pass
+	}
+	if len(out) > 127 {
+		out = out[:127]
+	}
+	return out
+}
+
+// alg2b implements Algorithm 2.B: Computing a hash (revision 6 and later) of
+// ISO 32000-2 Annex A. It derives the intermediate owner/user key hash from the
+// (processed) password, a salt and, when hashing for the owner entries, the
+// 48-byte U string.
+func (stdHandlerR6) alg2b(pass, salt, udata []byte) []byte {
+	h := sha256.New()
+	h.Write(pass)
+	h.Write(salt)
+	h.Write(udata)
+	K := h.Sum(nil)
+
+	for round := 0; ; round++ {
+		K1 := make([]byte, 0, 64*(len(pass)+len(K)+len(udata)))
+		for i := 0; i < 64; i++ {
+			K1 = append(K1, pass...)
+			K1 = append(K1, K...)
+			K1 = append(K1, udata...)
+		}
+
+		block, err := aes.NewCipher(K[0:16])
+		if err != nil {
+			panic(err)
+		}
+		E := make([]byte, len(K1))
+		cbc := cipher.NewCBCEncrypter(block, K[16:32])
+		cbc.CryptBlocks(E, K1)
+		Zero(K1)
+		Zero(K)
+
+		// Sum the first 16 bytes of E as a 128-bit big-endian integer and take
+		// it mod 3 to choose the next hash function.
+		sum := new(big.Int).SetBytes(E[0:16])
+		mod := new(big.Int).Mod(sum, big.NewInt(3)).Int64()
+		switch mod {
+		case 0:
+			sum256 := sha256.Sum256(E)
+			K = sum256[:]
+		case 1:
+			sum384 := sha512.Sum384(E)
+			K = sum384[:]
+		default:
+			sum512 := sha512.Sum512(E)
+			K = sum512[:]
+		}
+
+		// round is the number of rounds already completed, so the round
+		// count the spec checks against is round+1: stop once that count
+		// is at least 64 and the last byte of E is no greater than
+		// (round+1)-32, i.e. round-31.
+		stop := round >= 63 && int(E[len(E)-1]) <= round-31
+		Zero(E)
+		if stop {
+			break
+		}
+	}
+	hash := append([]byte{}, K[0:32]...)
+	Zero(K)
+	return hash
+}
+
+// alg8 implements Algorithm 8: Computing the encryption dictionary's U (user
+// password) and UE (user encryption key) values (revision 6 and later).
+func (sh stdHandlerR6) alg8(fkey, upass []byte) (U, UE []byte, err error) {
+	upass = sh.processPass(upass)
+	defer Zero(upass)
+
+	var validationSalt, keySalt [8]byte
+	if _, err = rand.Read(validationSalt[:]); err != nil {
+		return nil, nil, err
+	}
+	if _, err = rand.Read(keySalt[:]); err != nil {
+		return nil, nil, err
+	}
+
+	hash := sh.alg2b(upass, validationSalt[:], nil)
+	defer Zero(hash)
+	U = append(append([]byte{}, hash...), validationSalt[:]...)
+	U = append(U, keySalt[:]...)
+
+	ikey := sh.alg2b(upass, keySalt[:], nil)
+	defer Zero(ikey)
+	block, err := aes.NewCipher(ikey)
+	if err != nil {
+		return nil, nil, err
+	}
+	UE = make([]byte, 32)
+	cbc := cipher.NewCBCEncrypter(block, make([]byte, 16))
+	cbc.CryptBlocks(UE, fkey)
+	return U, UE, nil
+}
+
+// alg9 implements Algorithm 9: Computing the encryption dictionary's O (owner
+// password) and OE (owner encryption key) values (revision 6 and later).
+func (sh stdHandlerR6) alg9(fkey, opass, U []byte) (O, OE []byte, err error) {
+	opass = sh.processPass(opass)
+	defer Zero(opass)
+
+	var validationSalt, keySalt [8]byte
+	if _, err = rand.Read(validationSalt[:]); err != nil {
+		return nil, nil, err
+	}
+	if _, err = rand.Read(keySalt[:]); err != nil {
+		return nil, nil, err
+	}
+
+	hash := sh.alg2b(opass, validationSalt[:], U)
+	defer Zero(hash)
+	O = append(append([]byte{}, hash...), validationSalt[:]...)
+	O = append(O, keySalt[:]...)
+
+	ikey := sh.alg2b(opass, keySalt[:], U)
+	defer Zero(ikey)
+	block, err := aes.NewCipher(ikey)
+	if err != nil {
+		return nil, nil, err
+	}
+	OE = make([]byte, 32)
+	cbc := cipher.NewCBCEncrypter(block, make([]byte, 16))
+	cbc.CryptBlocks(OE, fkey)
+	return O, OE, nil
+}
+
+// alg10 implements Algorithm 10: Computing the encryption dictionary's Perms
+// (permissions) value (revision 6 and later).
+func (stdHandlerR6) alg10(fkey []byte, p Permissions, encryptMetadata bool) ([]byte, error) {
+	perms := make([]byte, 16)
+	binary := uint32(p)
+	perms[0] = byte(binary)
+	perms[1] = byte(binary >> 8)
+	perms[2] = byte(binary >> 16)
+	perms[3] = byte(binary >> 24)
+	perms[4] = 0xff
+	perms[5] = 0xff
+	perms[6] = 0xff
+	perms[7] = 0xff
+	if encryptMetadata {
+		perms[8] = 'T'
+	} else {
+		perms[8] = 'F'
+	}
+	perms[9] = 'a'
+	perms[10] = 'd'
+	perms[11] = 'b'
+	if _, err := rand.Read(perms[12:16]); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(fkey)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 16)
+	// ECB encryption, no padding, as specified by Algorithm 10.
+	block.Encrypt(out, perms)
+	return out, nil
+}
+
+// GenerateParams generates and sets O, U, OE, UE and Perms parameters for the
+// encryption dictionary. It expects R and P and EncryptMetadata fields to be set.
+// Unlike stdHandlerR4, the returned file encryption key is not derived from the
+// password at all: it is a fresh random 32-byte key that gets wrapped by the
+// user/owner password hashes, as required for R6.
+func (sh stdHandlerR6) GenerateParams(d *StdEncryptDict, opass, upass []byte) ([]byte, error) {
+	fkey := make([]byte, 32)
+	if _, err := rand.Read(fkey); err != nil {
+		Zero(fkey)
+		return nil, err
+	}
+
+	U, UE, err := sh.alg8(fkey, upass)
+	if err != nil {
+		common.Log.Debug("ERROR: Error generating U/UE for encryption (%s)", err)
+		Zero(fkey)
+		return nil, err
+	}
+	d.U, d.UE = U, UE
+
+	O, OE, err := sh.alg9(fkey, opass, d.U)
+	if err != nil {
+		common.Log.Debug("ERROR: Error generating O/OE for encryption (%s)", err)
+		Zero(fkey)
+		return nil, err
+	}
+	d.O, d.OE = O, OE
+
+	perms, err := sh.alg10(fkey, d.P, d.EncryptMetadata)
+	if err != nil {
+		common.Log.Debug("ERROR: Error generating Perms for encryption (%s)", err)
+		Zero(fkey)
+		return nil, err
+	}
+	d.Perms = perms
+
+	return fkey, nil
+}
+
+// unwrapKey decrypts a 32-byte UE/OE entry with the intermediate key derived
+// from pass, salt and udata, recovering the file encryption key.
+func (sh stdHandlerR6) unwrapKey(pass, salt, udata, we []byte) ([]byte, error) {
+	ikey := sh.alg2b(pass, salt, udata)
+	defer Zero(ikey)
+	block, err := aes.NewCipher(ikey)
+	if err != nil {
+		return nil, err
+	}
+	fkey := make([]byte, 32)
+	cbc := cipher.NewCBCDecrypter(block, make([]byte, 16))
+	cbc.CryptBlocks(fkey, we)
+	return fkey, nil
+}
+
+// Authenticate implements the StdHandler interface.
+func (sh stdHandlerR6) Authenticate(d *StdEncryptDict, pass []byte) ([]byte, Permissions, error) {
+	pass = sh.processPass(pass)
+	defer Zero(pass)
+
+	if len(d.O) < 48 || len(d.U) < 48 {
+		return nil, 0, errors.New("invalid O or U length for R6 handler")
+	}
+
+	// Try the owner password first: its hash input includes U.
+	oHash, oValSalt, oKeySalt := d.O[0:32], d.O[32:40], d.O[40:48]
+	oCheck := sh.alg2b(pass, oValSalt, d.U)
+	oMatch := bytes.Equal(oCheck, oHash)
+	Zero(oCheck)
+	if oMatch {
+		fkey, err := sh.unwrapKey(pass, oKeySalt, d.U, d.OE)
+		if err != nil {
+			return nil, 0, err
+		}
+		return fkey, PermOwner, nil
+	}
+
+	// Fall back to the user password.
+	uHash, uValSalt, uKeySalt := d.U[0:32], d.U[32:40], d.U[40:48]
+	uCheck := sh.alg2b(pass, uValSalt, nil)
+	uMatch := bytes.Equal(uCheck, uHash)
+	Zero(uCheck)
+	if uMatch {
+		fkey, err := sh.unwrapKey(pass, uKeySalt, nil, d.UE)
+		if err != nil {
+			return nil, 0, err
+		}
+		return fkey, d.P, nil
+	}
+
+	// Cannot even view the file.
+	return nil, 0, nil
+}
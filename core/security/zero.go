@@ -0,0 +1,25 @@
+/*
+ * This file is subject to the terms and conditions defined in
+ * file 'LICENSE.md', which is part of this source code package.
+ */
+
+package security
+
+// Zero overwrites buf with zeros in place. Handlers use it to scrub padded
+// passwords, hash intermediates and encryption keys as soon as they are no
+// longer needed, instead of leaving them on the heap for the GC to reclaim
+// whenever it gets around to it. This matters for long-running processes
+// that authenticate many encrypted PDFs over their lifetime.
+func Zero(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
+
+// KeyWiper is implemented by security handlers that can scrub a file
+// encryption key they previously returned from GenerateParams or
+// Authenticate. Callers that are done with a decrypted document should call
+// Wipe on the key once it is no longer needed.
+type KeyWiper interface {
+	Wipe(key []byte)
+}